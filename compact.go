@@ -0,0 +1,108 @@
+package msearch
+
+import "os"
+
+// allKeyOffsets 枚举一个 segment 里所有 key 的首条记录偏移：直接走 bucket 数组（而不是去扫值链
+// 记录区），因为记录区里混杂着后来追加的 bucket/overflow bucket，没法单靠 8 字节 total 字段
+// 区分出哪段是真正的记录。扩容没完成的话，新老两个 bucket 数组都要看：老数组里已经迁移过的
+// bucket 会在新数组里有一份一样的，跳过去避免重复。
+func (s *segment) allKeyOffsets() []int {
+	var offsets []int
+	walk := func(base int, b uint8, skipEvacuated bool) {
+		n := 1 << b
+		for i := 0; i < n; i++ {
+			bucket := bucketAt(base, i)
+			for {
+				if skipEvacuated {
+					if _, evacuated := s.overflow(bucket); evacuated {
+						break
+					}
+				}
+				for slot := 0; slot < bucketSlots; slot++ {
+					if s.slotTopHash(bucket, slot) != 0 {
+						offsets = append(offsets, s.slotOffset(bucket, slot))
+					}
+				}
+				next, _ := s.overflow(bucket)
+				if next == 0 {
+					break
+				}
+				bucket = next
+			}
+		}
+	}
+	if s.curOldB() != s.curB() {
+		walk(s.oldBucketsBase(), s.curOldB(), true)
+	}
+	walk(s.bucketsBase(), s.curB(), false)
+	return offsets
+}
+
+// keysSnapshot 返回这个 segment 里所有 key 的一份快照。
+func (s *segment) keysSnapshot() []string {
+	offsets := s.allKeyOffsets()
+	keys := make([]string, len(offsets))
+	for i, off := range offsets {
+		keys[i] = s.recordKey(off)
+	}
+	return keys
+}
+
+// Compact 把所有已经封存的 sealed segment 合并成一个：每个 key 的 value 取各个 segment 的并集，
+// 丢掉已经被墓碑标记删除的 value，合并完成后原地替换 s.sealed 并删除旧的 segment 文件。
+// active segment 还在写入，不参与合并。
+func (s *shard) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.sealed) < 2 {
+		return nil
+	}
+	old := s.sealed
+
+	var order []string
+	seenKey := make(map[string]struct{})
+	merged := make(map[string][]string)
+	seenValue := make(map[string]map[string]struct{})
+	for _, seg := range old {
+		for _, key := range seg.keysSnapshot() {
+			if _, ok := seenKey[key]; !ok {
+				seenKey[key] = struct{}{}
+				order = append(order, key)
+				seenValue[key] = make(map[string]struct{})
+			}
+			dead := s.tombstones[key]
+			for _, v := range seg.gets(key) {
+				if _, gone := dead[v]; gone {
+					continue
+				}
+				if _, dup := seenValue[key][v]; dup {
+					continue
+				}
+				seenValue[key][v] = struct{}{}
+				merged[key] = append(merged[key], v)
+			}
+		}
+	}
+
+	s.nextSegmentID++
+	newSeg, err := openSegment(s.nextSegmentID, s.segmentPath(s.nextSegmentID), s.length, s.maxValueSize, s.recoverStrict)
+	if err != nil {
+		return err
+	}
+	for _, key := range order {
+		values := merged[key]
+		if len(values) == 0 {
+			continue
+		}
+		if err = newSeg.adds(key, values...); err != nil {
+			return err
+		}
+	}
+
+	s.sealed = []*segment{newSeg}
+	for _, seg := range old {
+		_ = seg.close()
+		_ = os.Remove(seg.path)
+	}
+	return nil
+}
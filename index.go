@@ -0,0 +1,360 @@
+package msearch
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+)
+
+// 持久化索引区，结构参考 Go 运行时 map 的 hmap/bmap：
+// 文件开头是一段固定大小的头部，紧跟着是一个 bucket 数组；每个 bucket 固定 8 个槽位，
+// 槽位里存 1 字节 tophash（key 的 fnv64 哈希高 8 位）加 8 字节记录偏移，
+// tophash 命中之后才去读偏移处的记录确认 key 是否真的相等，这样大多数不命中的槽位
+// 一个字节的比较就能排除掉，不用每次都读完整的 key。
+// bucket 装满 8 个槽位之后，末尾的 overflow 字段指向新追加的一个溢出 bucket，串成链表。
+// 扩容时新 bucket 数组的大小翻倍，旧数组先保留着（oldBuckets），靠 nevacuate 记录
+// 已经迁移完成的旧 bucket 数，每次操作顺带迁移自己用得到的那个旧 bucket，
+// 把搬迁的开销摊到各次读写上，不会在扩容的瞬间卡住所有写入方。
+
+const (
+	indexMagic uint32 = 0x6d736831 // "msh1"
+	// indexVersion 2: value 的长度前缀从定长 1 字节改成了 uvarint（见 segment.go 的 add/get/
+	// del/delPrefix/empty1），不再有 255 字节的单 value 上限。
+	// indexVersion 3: 每个 value 前面加了一个 1 字节的 tag（0=空洞，1=真实记录），放在 uvarint
+	// 长度前面。不加这个 tag 的话，内容为空字符串的合法 value（uvarint(0) 编码出来正好是单字节
+	// 0x00）跟删除之后清零留下的空洞没法区分，会被空洞探测逻辑当成洞吞掉。
+	// 版本号不匹配的老文件直接拒绝打开，不做自动迁移——按老格式去读新版本数据，或者反过来，
+	// 都会读出垃圾。
+	indexVersion byte = 3
+
+	bucketSlots = 8                         // 每个 bucket 的槽位数，同 Go map 的 bmap
+	slotSize    = 1 + 8                      // tophash(1字节) + 记录偏移(8字节)
+	bucketSize  = bucketSlots*slotSize + 8   // 末尾 8 字节是 overflow bucket 偏移
+	initialB    = 3                         // 初始 2^3 = 8 个 bucket
+
+	headerSize = 64 // 索引头部大小，预留了一些空间方便以后加字段
+
+	// evacuatedFlag 借用 overflow 字段的最高位，标记这个 bucket 是否已经迁移完成。
+	// 真实的文件偏移不可能用到第 63 位，这样不用单独再开一个字段。
+	evacuatedFlag uint64 = 1 << 63
+)
+
+// 索引头部各字段在 bytesAddr 里的偏移
+const (
+	offMagic      = 0  // 4 字节，魔数，判断文件是否已经有索引
+	offVersion    = 4  // 1 字节
+	offB          = 5  // 1 字节，当前 bucket 数组的 log2(bucket 数)
+	offOldB       = 6  // 1 字节，等于 offB 表示当前没有在扩容
+	offNevacuate  = 8  // 8 字节，已经迁移完成的旧 bucket 数
+	offCount      = 16 // 8 字节，索引里 key 的个数
+	offBuckets    = 24 // 8 字节，当前 bucket 数组的文件偏移
+	offOldBuckets = 32 // 8 字节，扩容中的旧 bucket 数组的文件偏移
+	offDataTail   = 40 // 8 字节，value 链式记录区的追加游标（即 s.offset）
+)
+
+// createIndex 在文件末尾（此时应该是文件开头）写入索引头部和初始 bucket 数组。
+func (s *segment) createIndex() error {
+	n := 1 << initialB
+	zero := make([]byte, headerSize+n*bucketSize)
+	if _, err := s.f.Write(zero); err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint32(s.bytesAddr[offMagic:], indexMagic)
+	s.bytesAddr[offVersion] = indexVersion
+	s.bytesAddr[offB] = initialB
+	s.bytesAddr[offOldB] = initialB
+	binary.BigEndian.PutUint64(s.bytesAddr[offBuckets:], uint64(headerSize))
+	binary.BigEndian.PutUint64(s.bytesAddr[offOldBuckets:], uint64(headerSize))
+	s.offset = headerSize + n*bucketSize
+	s.setDataTail(s.offset)
+	return nil
+}
+
+// loadIndex 判断文件开头是否已经有索引头部的魔数，有的话直接从头部恢复游标，不用扫描整个文件。
+// ok 为 false 且 err 为 nil 时表示压根没有索引头部（老格式／崩溃恢复场景，交给 recoverLegacy）；
+// err 非 nil 时表示有索引头部但版本号对不上，没法安全地继续读。
+func (s *segment) loadIndex() (ok bool, err error) {
+	if binary.BigEndian.Uint32(s.bytesAddr[offMagic:]) != indexMagic {
+		return false, nil
+	}
+	if gotVersion := s.bytesAddr[offVersion]; gotVersion != indexVersion {
+		return false, fmt.Errorf("msearch: segment %s has format version %d, this build only supports version %d (no automatic migration)", s.path, gotVersion, indexVersion)
+	}
+	s.offset = int(binary.BigEndian.Uint64(s.bytesAddr[offDataTail:]))
+	return true, nil
+}
+
+func (s *segment) setDataTail(v int) {
+	binary.BigEndian.PutUint64(s.bytesAddr[offDataTail:], uint64(v))
+}
+
+func (s *segment) curB() uint8    { return s.bytesAddr[offB] }
+func (s *segment) curOldB() uint8 { return s.bytesAddr[offOldB] }
+
+func (s *segment) bucketsBase() int {
+	return int(binary.BigEndian.Uint64(s.bytesAddr[offBuckets:]))
+}
+func (s *segment) oldBucketsBase() int {
+	return int(binary.BigEndian.Uint64(s.bytesAddr[offOldBuckets:]))
+}
+
+func (s *segment) indexCount() int {
+	return int(binary.BigEndian.Uint64(s.bytesAddr[offCount:]))
+}
+func (s *segment) setIndexCount(v int) {
+	binary.BigEndian.PutUint64(s.bytesAddr[offCount:], uint64(v))
+}
+
+func (s *segment) nevacuate() int {
+	return int(binary.BigEndian.Uint64(s.bytesAddr[offNevacuate:]))
+}
+func (s *segment) setNevacuate(v int) {
+	binary.BigEndian.PutUint64(s.bytesAddr[offNevacuate:], uint64(v))
+}
+
+// hashKey 和 topHash 把 key 映射成 bucket 索引和 tophash 字节，算法跟 Go map 一样用 fnv 系列哈希即可。
+func hashKey(key string) uint64 {
+	h := fnv.New64()
+	_, _ = h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// topHash 取哈希的高 8 位；0 留给空槽位用，真撞上 0 就改成 1。
+func topHash(h uint64) byte {
+	t := byte(h >> 56)
+	if t == 0 {
+		t = 1
+	}
+	return t
+}
+
+func bucketIndex(h uint64, b uint8) int {
+	return int(h & (1<<b - 1))
+}
+
+func bucketAt(base int, idx int) int {
+	return base + idx*bucketSize
+}
+
+func (s *segment) slotTopHash(bucket int, slot int) byte {
+	return s.bytesAddr[bucket+slot*slotSize]
+}
+func (s *segment) setSlot(bucket int, slot int, top byte, offset int) {
+	s.bytesAddr[bucket+slot*slotSize] = top
+	binary.BigEndian.PutUint64(s.bytesAddr[bucket+slot*slotSize+1:], uint64(offset))
+}
+func (s *segment) slotOffset(bucket int, slot int) int {
+	return int(binary.BigEndian.Uint64(s.bytesAddr[bucket+slot*slotSize+1:]))
+}
+
+func (s *segment) overflow(bucket int) (next int, evacuated bool) {
+	v := binary.BigEndian.Uint64(s.bytesAddr[bucket+bucketSlots*slotSize:])
+	return int(v &^ evacuatedFlag), v&evacuatedFlag != 0
+}
+func (s *segment) setOverflow(bucket int, next int, evacuated bool) {
+	v := uint64(next)
+	if evacuated {
+		v |= evacuatedFlag
+	}
+	binary.BigEndian.PutUint64(s.bytesAddr[bucket+bucketSlots*slotSize:], v)
+}
+
+// newBucket 在记录区末尾追加一个全新的、全零的 bucket（零值 tophash 就是空槽，overflow 为 0 就是链表结尾）。
+// 必须真的把这 bucketSize 个零字节写到文件里、而不是只把 s.offset 往前挪：s.offset 只是逻辑游标，
+// 后续记录走 s.f.Write 顺序追加，靠的是文件的实际 EOF 跟 s.offset 对得上——光挪游标不落盘的话，
+// 这段 bucket 空间在磁盘上压根不存在，后面的 Write 会接到文件真正的 EOF（也就是这段 bucket 的
+// 起始位置）上，把刚分配出来的 bucket 数组整个覆盖掉。
+func (s *segment) newBucket() int {
+	off := s.offset
+	if _, err := s.f.Write(make([]byte, bucketSize)); err != nil {
+		panic(fmt.Sprintf("msearch: failed to extend segment %s for new bucket: %v", s.path, err))
+	}
+	s.offset += bucketSize
+	s.setDataTail(s.offset)
+	return off
+}
+
+// recordKey 读取某条记录里保存的 key，tophash 命中之后用它做最终确认。
+func (s *segment) recordKey(recordOffset int) string {
+	klen := int(s.bytesAddr[recordOffset+8])
+	return string(s.bytesAddr[recordOffset+9 : recordOffset+9+klen])
+}
+
+// lookup 在持久化索引里查找 key，返回它第一条记录的偏移。扩容没完成时，新老两个 bucket 数组都要找。
+func (s *segment) lookup(key string) (int, bool) {
+	h := hashKey(key)
+	top := topHash(h)
+	if s.curOldB() != s.curB() {
+		if off, ok := s.lookupIn(s.oldBucketsBase(), s.curOldB(), h, top, key); ok {
+			return off, true
+		}
+	}
+	return s.lookupIn(s.bucketsBase(), s.curB(), h, top, key)
+}
+
+func (s *segment) lookupIn(base int, b uint8, h uint64, top byte, key string) (int, bool) {
+	bucket := bucketAt(base, bucketIndex(h, b))
+	for {
+		for i := 0; i < bucketSlots; i++ {
+			if s.slotTopHash(bucket, i) != top {
+				continue
+			}
+			off := s.slotOffset(bucket, i)
+			if s.recordKey(off) == key {
+				return off, true
+			}
+		}
+		next, _ := s.overflow(bucket)
+		if next == 0 {
+			return 0, false
+		}
+		bucket = next
+	}
+}
+
+// indexReserve 为 key 在持久化索引里腾出一个空槽位：必要时触发扩容（maybeGrow）、顺带迁移一个
+// 旧 bucket（evacuateFor），追到 bucket 链末尾发现没有空位就追加一个新的 overflow bucket——
+// 但不会真的写入 tophash/offset。这几步都可能往文件末尾追加字节（newBucket 见 index.go），
+// 调用方必须在算出这条记录自己的 startOffset 之前做完这些事：segment.add 把 startOffset
+// 记进 keyMap 和持久化索引，是按"算出 startOffset 之后、记录落盘之前 s.offset 不会再被别的
+// 东西挪动"算出来的，如果扩容夹在算 startOffset 和真正落盘之间发生，记录实际会写到新追加的
+// bucket 后面，顺着 startOffset 去读会读到 bucket 数组的字节而不是真正的记录。indexPut 只负责
+// 把 indexReserve 已经腾出来的空位填上实际的 offset，调用时 s.offset 不会再变。
+func (s *segment) indexReserve(key string) {
+	s.maybeGrow()
+	h := hashKey(key)
+	s.evacuateFor(h)
+	bucket := bucketAt(s.bucketsBase(), bucketIndex(h, s.curB()))
+	for {
+		for i := 0; i < bucketSlots; i++ {
+			if s.slotTopHash(bucket, i) == 0 {
+				return
+			}
+		}
+		next, _ := s.overflow(bucket)
+		if next == 0 {
+			next = s.newBucket()
+			s.setOverflow(bucket, next, false)
+		}
+		bucket = next
+	}
+}
+
+// indexPut 把 key -> recordOffset 写进 indexReserve 已经腾出来的那个空槽位，只在这个 key
+// 第一次落盘时调用一次。调用前必须先调用过 indexReserve(key)，且这之间 s.offset 不能再变化。
+func (s *segment) indexPut(key string, recordOffset int) {
+	h := hashKey(key)
+	top := topHash(h)
+	bucket := bucketAt(s.bucketsBase(), bucketIndex(h, s.curB()))
+	for {
+		for i := 0; i < bucketSlots; i++ {
+			if s.slotTopHash(bucket, i) == 0 {
+				s.setSlot(bucket, i, top, recordOffset)
+				s.setIndexCount(s.indexCount() + 1)
+				return
+			}
+		}
+		next, _ := s.overflow(bucket)
+		if next == 0 {
+			// 不应该发生：indexReserve 已经在这条记录的 startOffset 确定之前把空位占住了。
+			next = s.newBucket()
+			s.setOverflow(bucket, next, false)
+		}
+		bucket = next
+	}
+}
+
+// maybeGrow 装载因子过高（超过 13/16）且当前没有正在进行的扩容时，开一次扩容：
+// 分配一个两倍大小的新 bucket 数组，旧数组先留着，交给后续的 evacuateFor 渐进式迁移。
+func (s *segment) maybeGrow() {
+	if s.curOldB() != s.curB() {
+		return
+	}
+	b := s.curB()
+	if s.indexCount() < (1<<b)*bucketSlots*13/16 {
+		return
+	}
+	newB := b + 1
+	newBase := s.offset
+	n := 1 << newB
+	// 跟 newBucket 一样，新 bucket 数组必须真的写到文件里占住这段空间，不能只挪 s.offset——
+	// 否则后面的记录 Write 会落在文件真正的 EOF（也就是这段数组应该在的位置），把它覆盖掉。
+	if _, err := s.f.Write(make([]byte, n*bucketSize)); err != nil {
+		panic(fmt.Sprintf("msearch: failed to extend segment %s for index growth: %v", s.path, err))
+	}
+	s.offset += n * bucketSize
+	s.setDataTail(s.offset)
+	binary.BigEndian.PutUint64(s.bytesAddr[offOldBuckets:], uint64(s.bucketsBase()))
+	s.bytesAddr[offOldB] = b
+	binary.BigEndian.PutUint64(s.bytesAddr[offBuckets:], uint64(newBase))
+	s.bytesAddr[offB] = newB
+	s.setNevacuate(0)
+}
+
+// evacuateFor 确保这次操作会用到的旧 bucket 已经迁移到新数组：命中就顺手搬一个，
+// 搬完所有旧 bucket 之后扩容才算真正结束。
+func (s *segment) evacuateFor(h uint64) {
+	if s.curOldB() == s.curB() {
+		return
+	}
+	oldBase := bucketAt(s.oldBucketsBase(), bucketIndex(h, s.curOldB()))
+	if _, evacuated := s.overflow(oldBase); !evacuated {
+		s.evacuateBucket(oldBase)
+	}
+	s.maybeFinishGrow()
+}
+
+// evacuateBucket 把一个旧 bucket（以及它挂着的溢出 bucket）里的条目按新的 bucket 数重新分布。
+func (s *segment) evacuateBucket(oldBase int) {
+	bucket := oldBase
+	for {
+		for i := 0; i < bucketSlots; i++ {
+			top := s.slotTopHash(bucket, i)
+			if top == 0 {
+				continue
+			}
+			off := s.slotOffset(bucket, i)
+			h := hashKey(s.recordKey(off))
+			newBucket := bucketAt(s.bucketsBase(), bucketIndex(h, s.curB()))
+			s.insertIntoChain(newBucket, top, off)
+		}
+		next, _ := s.overflow(bucket)
+		s.setOverflow(bucket, next, true)
+		if next == 0 {
+			break
+		}
+		bucket = next
+	}
+	s.setNevacuate(s.nevacuate() + 1)
+}
+
+func (s *segment) insertIntoChain(bucket int, top byte, off int) {
+	for {
+		for i := 0; i < bucketSlots; i++ {
+			if s.slotTopHash(bucket, i) == 0 {
+				s.setSlot(bucket, i, top, off)
+				return
+			}
+		}
+		next, _ := s.overflow(bucket)
+		if next == 0 {
+			next = s.newBucket()
+			s.setOverflow(bucket, next, false)
+		}
+		bucket = next
+	}
+}
+
+// maybeFinishGrow 所有旧 bucket 都迁移完了，就把旧数组指针收回来，扩容正式结束。
+func (s *segment) maybeFinishGrow() {
+	if s.curOldB() == s.curB() {
+		return
+	}
+	oldN := 1 << s.curOldB()
+	if s.nevacuate() < oldN {
+		return
+	}
+	s.bytesAddr[offOldB] = s.curB()
+	binary.BigEndian.PutUint64(s.bytesAddr[offOldBuckets:], uint64(s.bucketsBase()))
+	s.setNevacuate(0)
+}
@@ -0,0 +1,128 @@
+package msearch
+
+import "sort"
+
+// sortedKeySet 按字典序维护一个分片里出现过的所有 key，插入时用二分查找定位插入点。
+// 有了这份有序切片，ScanPrefix 就能用二分先定位到前缀区间的起点，再线性收集命中的 key，
+// 不用对着 keyMap 这种无序的 map 做全量扫描。
+type sortedKeySet struct {
+	keys []string
+}
+
+func newSortedKeySet() *sortedKeySet {
+	return &sortedKeySet{}
+}
+
+// add 插入一个 key，已经存在就什么都不做。
+func (s *sortedKeySet) add(key string) {
+	i := sort.SearchStrings(s.keys, key)
+	if i < len(s.keys) && s.keys[i] == key {
+		return
+	}
+	s.keys = append(s.keys, "")
+	copy(s.keys[i+1:], s.keys[i:])
+	s.keys[i] = key
+}
+
+// prefixRange 返回 keys 里以 prefix 开头的那一段的下标区间 [lo, hi)：lo 是二分查找出来的起点，
+// hi 从 lo 开始线性往后数，数到第一个不再以 prefix 开头的 key 为止——这一步只跟匹配到的
+// 数量成正比，加上前面二分的 O(log n)，整体就是 O(log n + matches)。
+func (s *sortedKeySet) prefixRange(prefix string) (lo, hi int) {
+	lo = sort.SearchStrings(s.keys, prefix)
+	hi = lo
+	for hi < len(s.keys) && len(s.keys[hi]) >= len(prefix) && s.keys[hi][:len(prefix)] == prefix {
+		hi++
+	}
+	return
+}
+
+// Keys 返回这个分片里所有 key 的一份快照，按字典序排列。
+func (s *shard) Keys() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make([]string, len(s.keys.keys))
+	copy(out, s.keys.keys)
+	return out
+}
+
+// snapshotMerged 在持锁状态下把 keys 对应的 (key, values) 整个取出来拷贝成一份快照：
+// fn 看到的是调用这一刻的数据，但不会在持锁时调用调用方代码——fn 里如果反过来调用
+// Add/Del/Get 这个分片，会因为 sync.RWMutex 不可重入而直接死锁。
+func (s *shard) snapshotMerged(keys []string) ([]string, [][]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	resultKeys := make([]string, 0, len(keys))
+	resultValues := make([][]string, 0, len(keys))
+	for _, key := range keys {
+		values := s.getMerged(key)
+		if len(values) == 0 {
+			continue
+		}
+		resultKeys = append(resultKeys, key)
+		resultValues = append(resultValues, values)
+	}
+	return resultKeys, resultValues
+}
+
+// Range 对这个分片里每个 key 当前的 value 列表依次调用 fn，fn 返回 false 就停止遍历并把
+// false 往上传给调用方（好让 Msearch.Range 也跟着停掉其它分片）。fn 看到的是调用这一刻的
+// 快照，调用 fn 的时候锁已经释放了，所以 fn 里可以放心地对这个分片做 Add/Del/Get。
+func (s *shard) Range(fn func(key string, values []string) bool) bool {
+	s.mu.RLock()
+	keys := make([]string, len(s.keys.keys))
+	copy(keys, s.keys.keys)
+	s.mu.RUnlock()
+	resultKeys, resultValues := s.snapshotMerged(keys)
+	for i, key := range resultKeys {
+		if !fn(key, resultValues[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// ScanPrefix 跟 Range 一样，只是只遍历 key 以 prefix 开头的那些条目。
+func (s *shard) ScanPrefix(prefix string, fn func(key string, values []string) bool) bool {
+	s.mu.RLock()
+	lo, hi := s.keys.prefixRange(prefix)
+	keys := make([]string, hi-lo)
+	copy(keys, s.keys.keys[lo:hi])
+	s.mu.RUnlock()
+	resultKeys, resultValues := s.snapshotMerged(keys)
+	for i, key := range resultKeys {
+		if !fn(key, resultValues[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Keys 返回当前存的所有 key 的一份快照。各分片内部按字典序排列，分片之间按分片下标顺序拼接，
+// 所以整体不是全局有序的。
+func (m *Msearch) Keys() []string {
+	var all []string
+	for _, sh := range m.shards {
+		all = append(all, sh.Keys()...)
+	}
+	return all
+}
+
+// Range 对每个 key 当前的 value 列表依次调用 fn，fn 返回 false 就提前结束遍历。
+// 分片之间顺序遍历，每个分片内部是调用那一刻的快照。
+func (m *Msearch) Range(fn func(key string, values []string) bool) {
+	for _, sh := range m.shards {
+		if !sh.Range(fn) {
+			return
+		}
+	}
+}
+
+// ScanPrefix 对 key 以 prefix 开头的条目依次调用 fn，fn 返回 false 就提前结束遍历。
+// key 按分片打散，所以要挨个分片各自做一次前缀扫描，没法只查一个分片就完事。
+func (m *Msearch) ScanPrefix(prefix string, fn func(key string, values []string) bool) {
+	for _, sh := range m.shards {
+		if !sh.ScanPrefix(prefix, fn) {
+			return
+		}
+	}
+}
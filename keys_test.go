@@ -0,0 +1,109 @@
+package msearch
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+)
+
+// TestKeysRangeScanPrefix 覆盖 Keys/Range/ScanPrefix 三个遍历接口：数据特意分到多个分片上
+// （WithShards(4)），确认这几个接口在跨分片拼接结果时也是对的，而不是只在单分片下碰巧正确。
+func TestKeysRangeScanPrefix(t *testing.T) {
+	dir := t.TempDir()
+	m, err := NewMsearch(dir, 1<<20, WithShards(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := make(map[string][]string)
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("user:%d", i)
+		values := []string{fmt.Sprintf("v%d-a", i), fmt.Sprintf("v%d-b", i)}
+		if err = m.Add(key, values...); err != nil {
+			t.Fatal(err)
+		}
+		want[key] = values
+	}
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("order:%d", i)
+		if err = m.Add(key, "o"); err != nil {
+			t.Fatal(err)
+		}
+		want[key] = []string{"o"}
+	}
+
+	keys := m.Keys()
+	if len(keys) != len(want) {
+		t.Fatalf("Keys() returned %d keys, want %d", len(keys), len(want))
+	}
+	seen := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		if _, ok := want[k]; !ok {
+			t.Fatalf("Keys() returned unexpected key %q", k)
+		}
+		seen[k] = true
+	}
+	for k := range want {
+		if !seen[k] {
+			t.Fatalf("Keys() is missing key %q", k)
+		}
+	}
+
+	visited := make(map[string]int, len(want))
+	m.Range(func(key string, values []string) bool {
+		visited[key]++
+		wantValues := want[key]
+		if len(values) != len(wantValues) {
+			t.Fatalf("Range(%s) = %v, want %v", key, values, wantValues)
+		}
+		for i, v := range values {
+			if v != wantValues[i] {
+				t.Fatalf("Range(%s) = %v, want %v", key, values, wantValues)
+			}
+		}
+		return true
+	})
+	if len(visited) != len(want) {
+		t.Fatalf("Range visited %d keys, want %d", len(visited), len(want))
+	}
+	for k, c := range visited {
+		if c != 1 {
+			t.Fatalf("Range visited %q %d times, want exactly once", k, c)
+		}
+	}
+
+	// fn 返回 false 应该让遍历提前停止——不光是当前分片内停，Msearch.Range 也不该再去查下一个分片。
+	calls := 0
+	m.Range(func(key string, values []string) bool {
+		calls++
+		return false
+	})
+	if calls != 1 {
+		t.Fatalf("Range should stop after the first fn() == false, got %d calls", calls)
+	}
+
+	var gotOrders []string
+	m.ScanPrefix("order:", func(key string, values []string) bool {
+		gotOrders = append(gotOrders, key)
+		return true
+	})
+	if len(gotOrders) != 10 {
+		t.Fatalf("ScanPrefix(order:) returned %d keys, want 10: %v", len(gotOrders), gotOrders)
+	}
+	sort.Strings(gotOrders)
+	for i, k := range gotOrders {
+		if want := fmt.Sprintf("order:%d", i); k != want {
+			t.Fatalf("ScanPrefix(order:) = %v, want keys order:0..order:9", gotOrders)
+		}
+	}
+
+	// "user:" 只应该命中 user:* 那 50 个 key，不该漏进任何 order:* 的 key。
+	userCount := 0
+	m.ScanPrefix("user:", func(key string, values []string) bool {
+		userCount++
+		return true
+	})
+	if userCount != 50 {
+		t.Fatalf("ScanPrefix(user:) matched %d keys, want 50", userCount)
+	}
+}
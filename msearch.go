@@ -1,24 +1,40 @@
 // Package msearch  基于mmap技术的，以本地文件为基础的搜索技术。提供增加、删、查（简单的替代mysql。）
-// 单个 value 长度不能超过255. // todo if needed?
-// [_8(total) _1 key  _1(len) xxx _1(len) xxx  _8(next) _8(overflow offset)]
-
+// 单个 value 默认最大 16 MiB（见 DefaultMaxValueSize/WithMaxValueSize）。
+// [_8(total) _1 key  _1(tag)uvarint(len) xxx  _1(tag)uvarint(len) xxx  _8(next) _8(overflow offset)]
+//
+// 存储结构参考了 InfluxDB TSM 的思路：每个分片（shard.go）的目录下是一串只追加写的 segment
+// 文件（见 segment.go），其中只有最新的一个（active）可以写入，写满到阈值就 seal 成只读，
+// 换一个新的 active。Del 对 active segment 里已有的数据直接原地清零，对已经 seal 掉、
+// 不能再改的老 segment 则记一条墓碑（见 tombstone.go），Get 的时候再按墓碑把老数据过滤掉。
+//
+// Msearch 本身只是按 key 的哈希把请求路由到某一个 shard：不同的 key 大概率落在不同分片，
+// 各自的锁、keyMap、segment 文件都是独立的，彼此的 Add/Del 不会阻塞别的分片上的 Get。
 package msearch
 
 import (
-	"encoding/binary"
-	"errors"
+	"fmt"
+	"hash/fnv"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
-	"syscall"
+	"time"
 )
 
-// notExist 标记不存在的key. // TODO 好像这个标记没什么用
-const notExist = -1
-
 // DefaultLength 默认映射空间大小 64 GB，不影响实际内存大小。
 const DefaultLength = 64 << 30
 
+// DefaultMaxSegmentSize 单个 segment 文件的数据区默认写到多大就封存、换下一个。
+const DefaultMaxSegmentSize = 256 << 20
+
+// DefaultShards 不指定分片数时的默认值：1，也就是不分片，行为等价于只有一个 shard。
+const DefaultShards = 1
+
+// DefaultMaxValueSize 单个 value 允许的默认最大长度：16 MiB。value 的长度前缀是 uvarint
+// 编码（见 segment.go），理论上不再有 255 字节那样的硬上限，这里只是给一个合理的默认兜底。
+const DefaultMaxValueSize = 16 << 20
+
 type MSearcher interface {
 	Add(key string, values ...string) error
 	Del(key string, values ...string)
@@ -26,355 +42,210 @@ type MSearcher interface {
 	DelByPrefix(key string, values ...string)
 	Update(key string, values ...string) error
 	Exist(key string) bool
+	Keys() []string
+	Range(fn func(key string, values []string) bool)
+	ScanPrefix(prefix string, fn func(key string, values []string) bool)
 }
 
 // Msearch  It's safe for concurrent use by multiple goroutines.
 type Msearch struct {
-	mu sync.RWMutex // mu to protect the follow fields
-	f  *os.File     // After the syscall.Mmap() call has returned, the file descriptor, fd, can be closed immediately
-	// without invalidating the mapping. But after f.Close(), we can't write any data to the file.
-	// So, the f should not call Close().
-	offset    int            // last offset of the f
-	keyMap    map[string]int // store all keys, value is the offset in bytesAddr of every key
-	bytesAddr []byte         // bytesAddr is the virtual address space of the process
-}
+	shards []*shard
+	mask   uint32 // len(shards) 是 2 的幂，mask = len(shards)-1，用来把哈希值映射到分片下标
 
-// NewMsearch create a new Msearch by file and length。
-// file is the path of the underlying file.
-// the length argument specifies the length of the mapping (which must be greater than 0)
-// it has no impact on the real memory. the default value is 64GB.
-func NewMsearch(file string, length int) (*Msearch, error) {
-	f, err := os.OpenFile(file, os.O_CREATE|os.O_RDWR, 0644)
-	if err != nil {
-		return nil, err
-	}
-	if length <= 0 {
-		length = DefaultLength
-	}
-	// 追加用f.Write 读取和修改用MMap
-	bytesAddr, err := syscall.Mmap(int(f.Fd()), 0, length, syscall.PROT_WRITE|syscall.PROT_READ, syscall.MAP_SHARED)
-	if err != nil {
-		return nil, err
-	}
-	return &Msearch{
-		mu:        sync.RWMutex{},
-		f:         f,
-		offset:    0,
-		keyMap:    make(map[string]int, 1<<10),
-		bytesAddr: bytesAddr,
-	}, nil
+	stopAutoCompact chan struct{} // 没开 WithAutoCompact 时是 nil，见 startAutoCompact/Close
+	autoCompactWG   sync.WaitGroup
 }
 
-// Get one or more value.
-func (s *Msearch) Get(key string) []string {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	return s.gets(key)
+// options 是 NewMsearch 的可选配置，只应该通过 With* 函数修改，零值等价于全部用默认值。
+type options struct {
+	maxSegmentSize int
+	maxValueSize   int
+	shards         int
+	recoverStrict  bool
+	autoCompact    time.Duration
 }
 
-// Add one or more value.
-func (s *Msearch) Add(key string, values ...string) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	return s.adds(key, values...)
+// Option 是 NewMsearch 的一个可选配置项，用函数式选项模式而不是挨个加 NewMsearchWithXxx
+// 构造函数，是因为这几个配置项彼此独立又都是可选的：只要再加一种组合就得再加一个构造函数，
+// 分片、崩溃恢复策略、自定义 value 长度上限这几个旋钮两两组合早就排列不过来了。
+type Option func(*options)
+
+// WithMaxSegmentSize 自定义 active segment 的数据区写到多大就封存，默认 DefaultMaxSegmentSize。
+func WithMaxSegmentSize(maxSegmentSize int) Option {
+	return func(o *options) { o.maxSegmentSize = maxSegmentSize }
 }
 
-// Del one or more value.
-func (s *Msearch) Del(key string, values ...string) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.dels(key, values...)
+// WithMaxValueSize 自定义单个 value 允许的最大长度，默认 DefaultMaxValueSize。
+func WithMaxValueSize(maxValueSize int) Option {
+	return func(o *options) { o.maxValueSize = maxValueSize }
 }
 
-// DelByPrefix 根据前缀删除.
-func (s *Msearch) DelByPrefix(key string, values ...string) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.delsPrefix(key, values...)
+// WithShards 按 shards 个分片打开/创建存储，shards 必须是 2 的幂（比如 8、16、32），默认
+// DefaultShards（不分片）。每个分片各自占 dir 下的一个子目录，有自己的锁、自己的一串 segment
+// 文件，读写互不阻塞——key 越分散，并发的 Add/Get 互相卡住的概率就越低。
+func WithShards(shards int) Option {
+	return func(o *options) { o.shards = shards }
 }
 
-// Update 更新。先删除所有老数据，然后更新新数据.
-func (s *Msearch) Update(key string, values ...string) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	oldValues := s.gets(key)
-	s.dels(key, oldValues...)
-	err := s.adds(key, values...)
-	return err
+// WithRecoverStrict 控制每个 segment 在缺失索引头部、需要靠扫描值链恢复时，遇到被截断或损坏的
+// 记录该怎么办：strict 为 true 时返回错误；为 false（默认）时只是丢弃这条记录之后的数据。
+func WithRecoverStrict(strict bool) Option {
+	return func(o *options) { o.recoverStrict = strict }
 }
 
-func (s *Msearch) Exist(key string) bool {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	if offset, ok := s.keyMap[key]; ok && offset != notExist {
-		return true
-	}
-	s.keyMap[key] = notExist
-	return false
+// WithAutoCompact 开一个后台 goroutine，每隔 interval 对所有分片各跑一次 Compact，不用调用方
+// 自己手动调度。interval <= 0（默认）表示不开，完全靠调用方手动调 Compact()。开了自动 compact
+// 的 Msearch 用完之后要调用 Close 停掉这个 goroutine，不然它会跟着进程一直跑下去。
+func WithAutoCompact(interval time.Duration) Option {
+	return func(o *options) { o.autoCompact = interval }
 }
-func (s *Msearch) delsPrefix(key string, values ...string) {
-	offset, ok := s.keyMap[key]
-	if !ok {
-		return
-	}
 
-	if len(values) == 0 {
-		return
+// NewMsearch create a new Msearch by dir and length。
+// dir 是存放数据的目录（不存在会自动创建），不传 opts 就是不分片、不自定义任何阈值。
+// the length argument specifies the length of the mapping (which must be greater than 0)
+// it has no impact on the real memory. the default value is 64GB.
+func NewMsearch(dir string, length int, opts ...Option) (*Msearch, error) {
+	o := options{
+		maxSegmentSize: DefaultMaxSegmentSize,
+		maxValueSize:   DefaultMaxValueSize,
+		shards:         DefaultShards,
 	}
-	for {
-		d := s.delPrefix(offset, values...)
-		if d == 0 {
-			break
-		}
-		offset = d
+	for _, opt := range opts {
+		opt(&o)
 	}
+	return newMsearch(dir, length, o)
 }
 
-func (s *Msearch) dels(key string, values ...string) {
-	offset, ok := s.keyMap[key]
-	if !ok {
-		return
+func newMsearch(dir string, length int, o options) (*Msearch, error) {
+	shards := o.shards
+	if shards <= 0 {
+		shards = DefaultShards
 	}
-	valueMap := make(map[string]struct{}, len(values))
-	for _, value := range values {
-		valueMap[value] = struct{}{}
-	}
-	if len(valueMap) == 0 {
-		return
+	if shards&(shards-1) != 0 {
+		return nil, fmt.Errorf("msearch: shards must be a power of two, got %d", shards)
 	}
-	for {
-		d := s.del(offset, valueMap)
-		if d == 0 {
-			break
-		}
-		offset = d
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
 	}
-}
-
-func (s *Msearch) gets(key string) []string {
-	offset, ok := s.keyMap[key]
-	if !ok || offset == notExist {
-		return nil
+	if err := checkShardsMarker(dir, shards); err != nil {
+		return nil, err
 	}
-	var lists []string
-	var d int
-	for {
-		var list []string
-		list, d = s.get(offset)
-		lists = append(lists, list...)
-		if d == 0 {
-			break
+	m := &Msearch{mask: uint32(shards - 1)}
+	for i := 0; i < shards; i++ {
+		shardDir := dir
+		if shards > 1 {
+			shardDir = filepath.Join(dir, fmt.Sprintf("shard-%02d", i))
 		}
-		offset = d
-	}
-	return lists
-}
-
-// empty 插入判断是否有空位，以及空位的长度.
-func (s *Msearch) empty(offset int) (o int, start int, end int, t bool) {
-	var lastDec int
-	for {
-		o, lastDec, start, end, t = s.empty1(offset)
-		if lastDec == 0 || t {
-			break
+		sh, err := newShard(shardDir, length, o.maxSegmentSize, o.maxValueSize, o.recoverStrict)
+		if err != nil {
+			return nil, err
 		}
-		offset = lastDec
+		m.shards = append(m.shards, sh)
 	}
-	return
-}
-
-// getB8byOffset 这个offset是每个value的起始offset 得到最后的一个8位 offset只能通过s.keyMap 获得。
-func (s *Msearch) getB8byOffset(offset int) (b8 []byte) {
-	var lastDec int
-	for {
-		lastDec, b8 = s.b8(offset)
-		if lastDec == 0 {
-			break
-		}
-		offset = lastDec
+	if o.autoCompact > 0 {
+		m.startAutoCompact(o.autoCompact)
 	}
-	return
+	return m, nil
 }
 
-// empty1 是否有空位，以及空位的长度.
-func (s *Msearch) empty1(offset int) (o int, lastDec int, start int, end int, t bool) {
-	// t为false的时候 也就是没有空位 有b8
-	var first bool
-	total := bigUint64(s.bytesAddr[offset : offset+8])
-	b := s.bytesAddr[offset : offset+total]
-	o = offset
-	for i := int(b[8] + 1 + 8); i < len(b[:len(b)-16]); {
-		if b[i] == 0 {
-			if !first {
-				first = true
-				t = true
-				start = i
-			}
-			i++
-			continue
-		}
-		if t {
-			end = i
-			return
+// checkShardsMarker 跟 shard.go 的 ACTIVE marker 是同一个思路：分片数是打开这个目录的前提，
+// 不像 segment 数据那样能靠重新扫描对出来，选错了也不会报错——只会悄悄把已有的数据路由到别的
+// 分片目录里，看起来像是数据全丢了。全新目录把这次的 shards 写进 SHARDS marker；已有目录则
+// 必须跟 marker 里记的一致，不一致就直接报错，不允许用不同的分片数重新打开同一个目录。
+func checkShardsMarker(dir string, shards int) error {
+	data, err := os.ReadFile(filepath.Join(dir, "SHARDS"))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
 		}
-		i += int(b[i]) + 1
+		return os.WriteFile(filepath.Join(dir, "SHARDS"), []byte(strconv.Itoa(shards)), 0644)
+	}
+	existing, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return fmt.Errorf("msearch: malformed SHARDS marker in %s: %w", dir, err)
 	}
-	if t && end == 0 {
-		end = total - 16
+	if existing != shards {
+		return fmt.Errorf("msearch: %s was created with %d shards, got %d (reopen it with the original shard count)", dir, existing, shards)
 	}
-	lastDec = bigUint64(b[total-8 : total])
-	return
+	return nil
 }
 
-func (s *Msearch) b8(offset int) (lastDec int, b8 []byte) {
-	// t为false的时候 也就是没有空位 有b8
-	if offset >= s.offset {
-		return 0, nil
-	}
-	total := bigUint64(s.bytesAddr[offset : offset+8])
-	b8 = s.bytesAddr[offset+total-8 : offset+total]
-	b := s.bytesAddr[offset : offset+total]
-	lastDec = bigUint64(b[total-8 : total])
-	return
+// shardFor 按 key 的 fnv32 哈希选一个分片，和 Go 自己 map 的分片思路一样，用 & mask 代替取模。
+func (m *Msearch) shardFor(key string) *shard {
+	return m.shards[fnv32(key)&m.mask]
 }
 
-func (s *Msearch) add(b8 []byte, key string, values ...string) (int, error) {
-	var b = make([]byte, 1<<10)
-	b[8] = byte(len(key))
-	n := copy(b[9:], key)
-	idx := n + 1 + 8
-	for _, value := range values {
-		if len(b) < idx+len(value)+2 {
-			// 容量不足就扩容 扩容一定要覆盖下面的copy
-			b = append(b, make([]byte, 1<<10)...)
-		}
-		// todo len(value)大于255？？
-		if len(value) > 255 {
-			return 0, errors.New("value exceed max length 255")
-		}
-		b[idx] = byte(len(value))
-		// 一定要注意copy的地方
-		copy(b[idx+1:], value)
-		idx += 1 + len(value)
-	}
-	total := idx + 16
-	binary.BigEndian.PutUint64(b[idx:], uint64(total+s.offset)) // todo 是否有必要？？
-	b = b[:total]
-	binary.BigEndian.PutUint64(b[:8], uint64(total))
-	_, err := s.f.Write(b)
-	if err != nil {
-		return 0, err
-	}
-	if i, ok := s.keyMap[key]; !ok || i == notExist {
-		s.keyMap[key] = s.offset
+func fnv32(key string) uint32 {
+	h := fnv.New32()
+	_, _ = h.Write([]byte(key))
+	return h.Sum32()
+}
 
-	}
-	if len(b8) > 0 {
-		// 末尾的
-		binary.BigEndian.PutUint64(b8, uint64(s.offset))
-	}
-	s.offset += total
-	return total, err
+// Get one or more value.
+func (m *Msearch) Get(key string) []string {
+	return m.shardFor(key).Get(key)
 }
-func (s *Msearch) adds(key string, values ...string) error {
-	if len(values) == 0 {
-		return nil
-	}
-	offset, ok := s.keyMap[key]
-	// 不存在
-	if !ok || offset == notExist {
-		_, err := s.add(nil, key, values...)
-		return err
-	}
-	// t 是否能插空 插空进入
-	// s.bytesAddr[offset:offset+8]
-	if len(values) == 1 {
-		value := values[0]
-		o, start, end, t := s.empty(offset)
-		if t && len(value) < (end-start) {
-			total := bigUint64(s.bytesAddr[offset : offset+8])
-			b := s.bytesAddr[o : o+total]
-			b[start] = byte(len(value))
-			copy(b[start+1:], value)
-			return nil
-		}
-	}
-	b8 := s.getB8byOffset(offset)
-	_, err := s.add(b8, key, values...)
-	return err
+
+// Add one or more value.
+func (m *Msearch) Add(key string, values ...string) error {
+	return m.shardFor(key).Add(key, values...)
 }
 
-func (s *Msearch) del(offset int, valueMap map[string]struct{}) int {
-	total := bigUint64(s.bytesAddr[offset : offset+8])
-	if total == 0 {
-		return 0
-	}
-	b := s.bytesAddr[offset : offset+total]
-	for i := int(b[8] + 1 + 8); i < len(b[:len(b)-16]); {
-		bi := int(b[i])
-		if bi == 0 {
-			i++
-			continue
-		}
-		value := string(b[i+1 : i+1+int(b[i])])
-		if _, ok := valueMap[value]; ok {
-			copy(b[i+1:i+1+int(b[i])], make([]byte, int(b[i])))
-			b[i] = 0
-		}
-		i += bi + 1
+// Del one or more value.
+func (m *Msearch) Del(key string, values ...string) {
+	m.shardFor(key).Del(key, values...)
+}
 
-	}
-	return bigUint64(b[total-8 : total])
+// DelByPrefix 根据前缀删除.
+func (m *Msearch) DelByPrefix(key string, values ...string) {
+	m.shardFor(key).DelByPrefix(key, values...)
 }
-func (s *Msearch) delPrefix(offset int, values ...string) int {
-	total := bigUint64(s.bytesAddr[offset : offset+8])
-	if total == 0 {
-		return 0
-	}
-	b := s.bytesAddr[offset : offset+total]
-	for i := int(b[8] + 1 + 8); i < len(b[:len(b)-16]); {
-		bi := int(b[i])
-		if bi == 0 {
-			i++
-			continue
-		}
-		value := string(b[i+1 : i+1+int(b[i])])
-		for _, v := range values {
-			if strings.HasPrefix(value, v) {
-				copy(b[i+1:i+1+int(b[i])], make([]byte, int(b[i])))
-				b[i] = 0
-			}
-		}
-		i += bi + 1
 
-	}
-	return bigUint64(b[total-8 : total])
+// Update 更新。先删除所有老数据，然后更新新数据.
+func (m *Msearch) Update(key string, values ...string) error {
+	return m.shardFor(key).Update(key, values...)
+}
+
+func (m *Msearch) Exist(key string) bool {
+	return m.shardFor(key).Exist(key)
 }
 
-func (s *Msearch) get(offset int) ([]string, int) {
-	total := bigUint64(s.bytesAddr[offset : offset+8])
-	b := s.bytesAddr[offset : offset+total]
-	var list []string
-	for i := int(b[8] + 1 + 8); i < len(b[:len(b)-16]); {
-		if b[i] == 0 {
-			i++
-			continue
+// Compact 对每个分片各自做一次 Compact，把分片里已经封存的 sealed segment 合并掉。
+func (m *Msearch) Compact() error {
+	for _, sh := range m.shards {
+		if err := sh.Compact(); err != nil {
+			return err
 		}
-		list = append(list, string(b[i+1:i+1+int(b[i])]))
-		i += int(b[i]) + 1
 	}
-	lastDec := bigUint64(b[total-8 : total])
-	return list, lastDec
+	return nil
+}
+
+// startAutoCompact 起一个后台 goroutine，每隔 interval 调一次 Compact，见 WithAutoCompact。
+func (m *Msearch) startAutoCompact(interval time.Duration) {
+	m.stopAutoCompact = make(chan struct{})
+	m.autoCompactWG.Add(1)
+	go func() {
+		defer m.autoCompactWG.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				_ = m.Compact()
+			case <-m.stopAutoCompact:
+				return
+			}
+		}
+	}()
 }
 
-// bigUint64 对大数字进行解码 长度为0-8位的字节切片. binary.BigEndian.PutUint64 是编码.
-func bigUint64(buf []byte) int {
-	if len(buf) > 8 {
-		return 0
-	}
-	var x int
-	for _, b := range buf {
-		x = x<<8 | int(b)
+// Close 停掉 WithAutoCompact 开的后台 compact goroutine（如果开了的话），等它退出再返回；
+// 没开自动 compact 时是个空操作。不会关闭底层 segment 文件，也不会 munmap，
+// 文件描述符和映射都靠进程退出来回收。
+func (m *Msearch) Close() {
+	if m.stopAutoCompact == nil {
+		return
 	}
-	return x
+	close(m.stopAutoCompact)
+	m.autoCompactWG.Wait()
 }
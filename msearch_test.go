@@ -0,0 +1,261 @@
+package msearch
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestFreshOpen 覆盖最基本的路径：全新目录上创建、Add、Get 的往返结果是否正确，
+// 顺带也跑过 openSegment 在全新空文件上的那条分支（见 segment.go 的 info.Size() == 0 判断）。
+func TestFreshOpen(t *testing.T) {
+	m, err := NewMsearch(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Add("k1", "a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	got := m.Get("k1")
+	if len(got) != 2 || got[0] != "a" || got[1] != "b" {
+		t.Fatalf("Get(k1) = %v, want [a b]", got)
+	}
+	if got := m.Get("missing"); len(got) != 0 {
+		t.Fatalf("Get(missing) = %v, want empty", got)
+	}
+	if !m.Exist("k1") || m.Exist("missing") {
+		t.Fatalf("Exist mismatch for k1/missing")
+	}
+
+	// Add("k2", "", "b") 的空字符串 value 不该被空洞探测逻辑当成洞丢掉（见 segment.go 的 presence tag）。
+	if err = m.Add("k2", "", "b"); err != nil {
+		t.Fatal(err)
+	}
+	got = m.Get("k2")
+	if len(got) != 2 || got[0] != "" || got[1] != "b" {
+		t.Fatalf("Get(k2) = %q, want [\"\" b]", got)
+	}
+}
+
+// TestLargeValue 覆盖超过老的 1KiB 固定扩容增量、也超过老的 255 字节单字节长度前缀上限的 value，
+// 确认 segment.add 按需扩容而不是 panic。
+func TestLargeValue(t *testing.T) {
+	m, err := NewMsearch(t.TempDir(), 16<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	big := strings.Repeat("x", 2<<20) // 2 MiB，远超旧的 1KiB 扩容步长和 255 字节上限
+	if err = m.Add("big", big); err != nil {
+		t.Fatal(err)
+	}
+	got := m.Get("big")
+	if len(got) != 1 || got[0] != big {
+		t.Fatalf("Get(big) length = %d, want %d", len(got[0]), len(big))
+	}
+}
+
+// TestRotateDelReAddRecoversValue 覆盖"段轮转后删除、再重新 Add 回同一个 value"这条路径：
+// value 先落在一个已经 seal 掉的 segment 里，删除会给它记一条墓碑，重新 Add 回来之后
+// 这条墓碑必须被撤销，否则 Get 会把刚写回去的数据又当成已删除的过滤掉。
+func TestRotateDelReAddRecoversValue(t *testing.T) {
+	dir := t.TempDir()
+	m, err := NewMsearch(dir, 1<<20, WithMaxSegmentSize(1<<10)) // 很小的阈值，方便触发 rotate
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Add("k", "v0"); err != nil {
+		t.Fatal(err)
+	}
+	// 灌一堆别的 key，把 active segment 写过阈值，触发 rotate，让 "k" 落进 sealed segment。
+	for i := 0; i < 200; i++ {
+		if err = m.Add(fmt.Sprintf("filler-%d", i), strings.Repeat("y", 64)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(m.shards[0].sealed) == 0 {
+		t.Fatal("expected at least one sealed segment after filling past maxSegmentSize")
+	}
+	if got := m.Get("k"); len(got) != 1 || got[0] != "v0" {
+		t.Fatalf("Get(k) before delete = %v, want [v0]", got)
+	}
+
+	m.Del("k", "v0")
+	if got := m.Get("k"); len(got) != 0 {
+		t.Fatalf("Get(k) after delete = %v, want empty", got)
+	}
+
+	if err = m.Add("k", "v0"); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.Get("k"); len(got) != 1 || got[0] != "v0" {
+		t.Fatalf("Get(k) after re-add = %v, want [v0] (tombstone should have been lifted)", got)
+	}
+}
+
+// TestRotateCompact 覆盖多个 sealed segment 存在、其中有些 value 已经被删除的情况下 Compact
+// 的合并结果：幸存的 value 应该还在，被删掉的不该再出现，并且合并之后 sealed 只剩一个 segment。
+func TestRotateCompact(t *testing.T) {
+	dir := t.TempDir()
+	m, err := NewMsearch(dir, 1<<20, WithMaxSegmentSize(1<<10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 400; i++ {
+		key := fmt.Sprintf("k%d", i)
+		if err = m.Add(key, fmt.Sprintf("v%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(m.shards[0].sealed) < 2 {
+		t.Fatalf("expected at least 2 sealed segments, got %d", len(m.shards[0].sealed))
+	}
+
+	m.Del("k0", "v0")
+
+	if err = m.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.shards[0].sealed) != 1 {
+		t.Fatalf("expected exactly 1 sealed segment after Compact, got %d", len(m.shards[0].sealed))
+	}
+	if got := m.Get("k0"); len(got) != 0 {
+		t.Fatalf("Get(k0) after delete+compact = %v, want empty", got)
+	}
+	if got := m.Get("k399"); len(got) != 1 || got[0] != "v399" {
+		t.Fatalf("Get(k399) after compact = %v, want [v399]", got)
+	}
+}
+
+// TestReopenPreservesData 覆盖"关掉进程再重新打开同一个目录"这条最根本的路径：数据量要大到
+// 足够触发 segment 轮转（多个 sealed segment）和持久化索引扩容（index.go 的 maybeGrow），
+// 因为这两处都是直接读写磁盘文件的逻辑，内存里随便测一遍测不出重新打开之后还能不能读对。
+func TestReopenPreservesData(t *testing.T) {
+	dir := t.TempDir()
+	m1, err := NewMsearch(dir, 1<<20, WithShards(4), WithMaxSegmentSize(1<<10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprintf("k%d", i)
+		if err = m1.Add(key, fmt.Sprintf("v%d", i), fmt.Sprintf("v%d-2", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m1.Del("k1", "v1-2")
+	if err = m1.Add("k1", "v1-3"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 不调用 m1 的任何方法就直接在同一个目录上再开一份，模拟进程重启后重新加载。
+	m2, err := NewMsearch(dir, 1<<20, WithShards(4), WithMaxSegmentSize(1<<10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprintf("k%d", i)
+		want := []string{fmt.Sprintf("v%d", i), fmt.Sprintf("v%d-2", i)}
+		if i == 1 {
+			want = []string{"v1", "v1-3"}
+		}
+		got := m2.Get(key)
+		if len(got) != len(want) {
+			t.Fatalf("Get(%s) after reopen = %v, want %v", key, got, want)
+		}
+		for j, v := range want {
+			if got[j] != v {
+				t.Fatalf("Get(%s) after reopen = %v, want %v", key, got, want)
+			}
+		}
+	}
+	keys := m2.Keys()
+	if len(keys) != 300 {
+		t.Fatalf("Keys() after reopen returned %d keys, want 300", len(keys))
+	}
+}
+
+// TestReopenRejectsMismatchedShardCount 覆盖用跟创建时不一样的分片数重新打开同一个目录的情况：
+// 不该悄悄成功（那会把 key 路由到别的分片目录，看起来像数据全丢了），而是要报错。
+func TestReopenRejectsMismatchedShardCount(t *testing.T) {
+	dir := t.TempDir()
+	m1, err := NewMsearch(dir, 1<<20, WithShards(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if err = m1.Add(fmt.Sprintf("k%d", i), "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = NewMsearch(dir, 1<<20); err == nil {
+		t.Fatal("NewMsearch with default shard count on an 8-shard dir should fail, got nil error")
+	}
+	if _, err = NewMsearch(dir, 1<<20, WithShards(16)); err == nil {
+		t.Fatal("NewMsearch with 16 shards on an 8-shard dir should fail, got nil error")
+	}
+	m2, err := NewMsearch(dir, 1<<20, WithShards(8))
+	if err != nil {
+		t.Fatalf("reopening with the original shard count should succeed: %v", err)
+	}
+	if len(m2.Keys()) != 100 {
+		t.Fatalf("Keys() after correct reopen = %d, want 100", len(m2.Keys()))
+	}
+}
+
+// writeLegacyRecord 按老格式（recoverLegacy 扫描的那种：单字节 key 长度、单字节 value 长度，
+// 没有索引头部的魔数）拼一条记录，追加到 buf 后面返回。这是持久化索引（index.go）加入之前的
+// 文件布局，recoverLegacy 存在就是为了扫描这种老文件、或者扫描一个没写完索引头部就崩溃的文件。
+func writeLegacyRecord(buf []byte, key string, values ...string) []byte {
+	start := len(buf)
+	buf = append(buf, make([]byte, 8)...) // total，稍后回填
+	buf = append(buf, byte(len(key)))
+	buf = append(buf, key...)
+	for _, v := range values {
+		buf = append(buf, byte(len(v)))
+		buf = append(buf, v...)
+	}
+	buf = append(buf, make([]byte, 16)...) // 尾部 next/overflow 字段，recoverLegacy 不看这两个
+	total := len(buf) - start
+	binary.BigEndian.PutUint64(buf[start:], uint64(total))
+	return buf
+}
+
+// TestReopenWithRecoverStrict 覆盖 segment 文件是老格式（没有索引头部魔数，recoverLegacy 扫描
+// 值链重建）又被截断（模拟崩溃：最后一条记录没写完整）的情况：WithRecoverStrict(true) 应该
+// 直接报错；默认（false）应该丢弃截断的那条记录、把前面完整写过的数据正常恢复出来。
+func TestReopenWithRecoverStrict(t *testing.T) {
+	var buf []byte
+	for i := 0; i < 20; i++ {
+		buf = writeLegacyRecord(buf, fmt.Sprintf("k%d", i), fmt.Sprintf("v%d", i))
+	}
+	truncated := buf[:len(buf)-3] // 砍掉最后 3 个字节，弄出一条不完整的记录
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "segment-00000001.ms"), truncated, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewMsearch(dir, 1<<20, WithRecoverStrict(true)); err == nil {
+		t.Fatal("WithRecoverStrict(true) should fail to open a truncated legacy segment, got nil error")
+	}
+
+	dir2 := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir2, "segment-00000001.ms"), truncated, 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewMsearch(dir2, 1<<20)
+	if err != nil {
+		t.Fatalf("default (non-strict) recovery should not fail: %v", err)
+	}
+	for i := 0; i < 19; i++ {
+		key := fmt.Sprintf("k%d", i)
+		want := fmt.Sprintf("v%d", i)
+		if got := m.Get(key); len(got) != 1 || got[0] != want {
+			t.Fatalf("Get(%s) after truncated-recovery reopen = %v, want [%s]", key, got, want)
+		}
+	}
+	if got := m.Get("k19"); len(got) != 0 {
+		t.Fatalf("Get(k19) for the truncated record = %v, want empty (it was cut off mid-write)", got)
+	}
+}
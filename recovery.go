@@ -0,0 +1,60 @@
+package msearch
+
+import "fmt"
+
+// recoverLegacy 处理打开的文件里没有索引头部魔数、但已经有数据的情况——典型场景是这个文件是在
+// 持久化索引（见 index.go）加入之前写的，记录是从文件开头 0 偏移直接一条接一条排列的。
+// 这里按值链的记录格式（8字节total + key + 若干value + 8字节next + 8字节overflow offset）逐条往后扫描，重建每个 key
+// 曾经写过的 value，然后顺着现在的写入路径（adds）把它们重新落盘到"索引头部 + bucket 数组"
+// 之后的新布局里，这样旧文件下次打开就能走 loadIndex 的快路径，而不用每次都重新扫描一遍。
+func (s *segment) recoverLegacy(fileSize int, recoverStrict bool) error {
+	type entry struct {
+		key    string
+		values []string
+	}
+	var entries []entry
+	offset := 0
+	for offset < fileSize {
+		if offset+8 > fileSize {
+			if recoverStrict {
+				return fmt.Errorf("msearch: truncated record header at offset %d, file size=%d", offset, fileSize)
+			}
+			break
+		}
+		total := bigUint64(s.bytesAddr[offset : offset+8])
+		if total == 0 || offset+total > fileSize {
+			// total 为 0，或者 offset+total 超出了文件大小，说明这是重启前没写完整的最后一条记录。
+			if recoverStrict {
+				return fmt.Errorf("msearch: corrupt or truncated record at offset %d (total=%d, file size=%d)", offset, total, fileSize)
+			}
+			break
+		}
+		b := s.bytesAddr[offset : offset+total]
+		klen := int(b[8])
+		key := string(b[9 : 9+klen])
+		var values []string
+		for i := klen + 1 + 8; i < total-16; {
+			if b[i] == 0 {
+				i++
+				continue
+			}
+			vlen := int(b[i])
+			values = append(values, string(b[i+1:i+1+vlen]))
+			i += vlen + 1
+		}
+		if len(values) > 0 {
+			entries = append(entries, entry{key: key, values: values})
+		}
+		offset += total
+	}
+	// 能用的记录都已经读到内存里了，现在才能放心地在文件开头铺上索引头部和 bucket 数组。
+	if err := s.createIndex(); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := s.adds(e.key, e.values...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
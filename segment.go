@@ -0,0 +1,440 @@
+package msearch
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// segment 是单个底层数据文件的读写引擎：一段 mmap 起来的文件，开头是持久化的 bucket 索引
+// （见 index.go），后面跟着 value 的链式记录区。以前 Msearch 自己就是这么一个文件，现在
+// 每个 shard（见 shard.go）管理一串 segment 文件——一个可写的 active segment，
+// 加上若干只读的、已经 seal 过的 sealed segment，结构上参照了 InfluxDB TSM 的思路。
+// segment 本身不关心自己是 active 还是 sealed，是不是该接受写入完全由上层 shard 决定。
+type segment struct {
+	id           int
+	path         string
+	f            *os.File
+	offset       int // value 链式记录区的追加游标
+	maxValueSize int // 单个 value 允许的最大长度，见 WithMaxValueSize
+	keyMap       map[string]int
+	bytesAddr    []byte
+}
+
+// openSegment 打开（或新建）一个 segment 文件：全新文件就初始化一份空索引；已经有索引头部的
+// 文件直接从头部恢复游标；没有索引头部但又有数据的，说明是崩溃恢复／老格式迁移的场景，
+// 走 recoverLegacy 重新扫描重建（recoverStrict 控制遇到截断数据时是报错还是丢弃）。
+// maxValueSize <= 0 时回落到 DefaultMaxValueSize。
+func openSegment(id int, path string, length int, maxValueSize int, recoverStrict bool) (*segment, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if length <= 0 {
+		length = DefaultLength
+	}
+	if maxValueSize <= 0 {
+		maxValueSize = DefaultMaxValueSize
+	}
+	bytesAddr, err := syscall.Mmap(int(f.Fd()), 0, length, syscall.PROT_WRITE|syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	s := &segment{
+		id:           id,
+		path:         path,
+		f:            f,
+		maxValueSize: maxValueSize,
+		keyMap:       make(map[string]int, 1<<10),
+		bytesAddr:    bytesAddr,
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	// 全新的空文件不能先去 loadIndex：mmap 出来的页还没有任何数据落盘，读 offMagic 会触发
+	// SIGBUS，必须先判断文件大小，只有非空文件才去探测索引头部的魔数。
+	switch {
+	case info.Size() == 0:
+		if err = s.createIndex(); err != nil {
+			return nil, err
+		}
+	default:
+		loaded, err := s.loadIndex()
+		switch {
+		case err != nil:
+			return nil, err
+		case loaded:
+			if _, err = s.f.Seek(int64(s.offset), io.SeekStart); err != nil {
+				return nil, err
+			}
+		default:
+			if err = s.recoverLegacy(int(info.Size()), recoverStrict); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return s, nil
+}
+
+// close 只是放弃这个 segment 的文件描述符，不会删除文件，也不会 munmap（munmap 之后其它
+// 还持有 bytesAddr 切片的 goroutine 会立刻崩溃，这里偷懒依赖进程退出或者调用方自己控制生命周期）。
+func (s *segment) close() error {
+	return s.f.Close()
+}
+
+// resolve 查找 key 对应的首条记录偏移，优先查内存里的 keyMap 缓存，
+// 缓存没有命中时再去持久化的 bucket 索引里找，找到后回填缓存。
+func (s *segment) resolve(key string) (int, bool) {
+	if offset, ok := s.keyMap[key]; ok {
+		if offset == notExist {
+			return 0, false
+		}
+		return offset, true
+	}
+	if offset, ok := s.lookup(key); ok {
+		s.keyMap[key] = offset
+		return offset, true
+	}
+	s.keyMap[key] = notExist
+	return 0, false
+}
+
+// resolveCached 只读地查 keyMap 缓存，不碰持久化索引、也不会回填 keyMap；ok 表示 keyMap 里
+// 已经缓存过这个 key（命中或者显式记过"不存在"），调用方靠 ok 判断能不能只用只读锁处理这次
+// 查询——resolve 在缓存没命中时会去翻持久化索引并写 keyMap，这一步在只读锁下是不安全的。
+func (s *segment) resolveCached(key string) (offset int, found bool, ok bool) {
+	if off, cached := s.keyMap[key]; cached {
+		if off == notExist {
+			return 0, false, true
+		}
+		return off, true, true
+	}
+	return 0, false, false
+}
+
+// getsCached 跟 gets 一样顺着链取 key 的所有 value，但只用 resolveCached，查不到缓存就直接
+// 返回 ok=false，绝不会像 gets/resolve 那样去翻持久化索引、回填 keyMap。
+func (s *segment) getsCached(key string) (values []string, ok bool) {
+	offset, found, ok := s.resolveCached(key)
+	if !ok {
+		return nil, false
+	}
+	if !found {
+		return nil, true
+	}
+	var lists []string
+	var d int
+	for {
+		var list []string
+		list, d = s.get(offset)
+		lists = append(lists, list...)
+		if d == 0 {
+			break
+		}
+		offset = d
+	}
+	return lists, true
+}
+
+func (s *segment) delsPrefix(key string, values ...string) {
+	offset, ok := s.resolve(key)
+	if !ok {
+		return
+	}
+	if len(values) == 0 {
+		return
+	}
+	for {
+		d := s.delPrefix(offset, values...)
+		if d == 0 {
+			break
+		}
+		offset = d
+	}
+}
+
+func (s *segment) dels(key string, values ...string) {
+	offset, ok := s.resolve(key)
+	if !ok {
+		return
+	}
+	valueMap := make(map[string]struct{}, len(values))
+	for _, value := range values {
+		valueMap[value] = struct{}{}
+	}
+	if len(valueMap) == 0 {
+		return
+	}
+	for {
+		d := s.del(offset, valueMap)
+		if d == 0 {
+			break
+		}
+		offset = d
+	}
+}
+
+func (s *segment) gets(key string) []string {
+	offset, ok := s.resolve(key)
+	if !ok {
+		return nil
+	}
+	var lists []string
+	var d int
+	for {
+		var list []string
+		list, d = s.get(offset)
+		lists = append(lists, list...)
+		if d == 0 {
+			break
+		}
+		offset = d
+	}
+	return lists
+}
+
+// empty 插入判断是否有空位，以及空位的长度.
+func (s *segment) empty(offset int) (o int, start int, end int, t bool) {
+	var lastDec int
+	for {
+		o, lastDec, start, end, t = s.empty1(offset)
+		if lastDec == 0 || t {
+			break
+		}
+		offset = lastDec
+	}
+	return
+}
+
+// getB8byOffset 这个offset是每个value的起始offset 得到最后的一个8位 offset只能通过s.keyMap 获得。
+func (s *segment) getB8byOffset(offset int) (b8 []byte) {
+	var lastDec int
+	for {
+		lastDec, b8 = s.b8(offset)
+		if lastDec == 0 {
+			break
+		}
+		offset = lastDec
+	}
+	return
+}
+
+// empty1 是否有空位，以及空位的长度.
+func (s *segment) empty1(offset int) (o int, lastDec int, start int, end int, t bool) {
+	// t为false的时候 也就是没有空位 有b8
+	var first bool
+	total := bigUint64(s.bytesAddr[offset : offset+8])
+	b := s.bytesAddr[offset : offset+total]
+	o = offset
+	for i := int(b[8] + 1 + 8); i < len(b[:len(b)-16]); {
+		if b[i] == 0 {
+			if !first {
+				first = true
+				t = true
+				start = i
+			}
+			i++
+			continue
+		}
+		if t {
+			end = i
+			return
+		}
+		vlen, n := binary.Uvarint(b[i+1:])
+		i += 1 + n + int(vlen)
+	}
+	if t && end == 0 {
+		end = total - 16
+	}
+	lastDec = bigUint64(b[total-8 : total])
+	return
+}
+
+func (s *segment) b8(offset int) (lastDec int, b8 []byte) {
+	// t为false的时候 也就是没有空位 有b8
+	if offset >= s.offset {
+		return 0, nil
+	}
+	total := bigUint64(s.bytesAddr[offset : offset+8])
+	b8 = s.bytesAddr[offset+total-8 : offset+total]
+	b := s.bytesAddr[offset : offset+total]
+	lastDec = bigUint64(b[total-8 : total])
+	return
+}
+
+func (s *segment) add(b8 []byte, key string, values ...string) (int, error) {
+	i, ok := s.keyMap[key]
+	isNewKey := !ok || i == notExist
+	if isNewKey {
+		// 必须在 startOffset 确定之前把索引扩容/渐进迁移/新开 overflow bucket 这些会往文件
+		// 末尾追加字节的操作做掉（见 indexReserve），不然下面这条记录真正落盘的位置会跟着
+		// 往后挪，但记到 keyMap 和持久化索引里的 startOffset 已经按挪之前的位置定死了。
+		s.indexReserve(key)
+	}
+	startOffset := s.offset
+	var b = make([]byte, 1<<10)
+	b[8] = byte(len(key))
+	n := copy(b[9:], key)
+	idx := n + 1 + 8
+	for _, value := range values {
+		if len(value) > s.maxValueSize {
+			return 0, fmt.Errorf("value exceed max length %d", s.maxValueSize)
+		}
+		if need := idx + 1 + binary.MaxVarintLen64 + len(value); len(b) < need {
+			// 容量不足就扩容到刚好够用，而不是固定加 1KiB——value 可以到 maxValueSize
+			// （默认 16MiB），固定增量早就不够用了。
+			b = append(b, make([]byte, need-len(b))...)
+		}
+		// 先写一个非 0 的 tag 字节，标记"这里是一条真正的记录"，再跟 uvarint 长度。空位
+		// 删除之后是整段清零，tag 字节也是 0，这样才能跟"内容为空字符串的合法 value"
+		// （uvarint(0) 本身编码也是单字节 0x00）区分开。
+		b[idx] = 1
+		vn := binary.PutUvarint(b[idx+1:], uint64(len(value)))
+		// 一定要注意copy的地方
+		copy(b[idx+1+vn:], value)
+		idx += 1 + vn + len(value)
+	}
+	total := idx + 16
+	if len(b) < total {
+		// 循环里按每个 value 自己的大小扩容，没有算上这里额外的 16 字节尾巴（next 偏移 +
+		// overflow 偏移），值足够大、刚好把缓冲区撑满的时候尾巴会越界，这里补一次。
+		b = append(b, make([]byte, total-len(b))...)
+	}
+	binary.BigEndian.PutUint64(b[idx:], uint64(total+s.offset)) // todo 是否有必要？？
+	b = b[:total]
+	binary.BigEndian.PutUint64(b[:8], uint64(total))
+	_, err := s.f.Write(b)
+	if err != nil {
+		return 0, err
+	}
+	if isNewKey {
+		s.keyMap[key] = startOffset
+		// 这是这个 key 在这个 segment 里第一次落盘，记到持久化索引里，这样重启之后不用重新扫描
+		// 整个 segment 就能找到它。空位已经被上面的 indexReserve 占住了，这里只是把 offset 填进去。
+		s.indexPut(key, startOffset)
+	}
+	if len(b8) > 0 {
+		// 末尾的
+		binary.BigEndian.PutUint64(b8, uint64(s.offset))
+	}
+	s.offset += total
+	s.setDataTail(s.offset)
+	return total, err
+}
+
+func (s *segment) adds(key string, values ...string) error {
+	if len(values) == 0 {
+		return nil
+	}
+	offset, ok := s.resolve(key)
+	// 不存在
+	if !ok {
+		_, err := s.add(nil, key, values...)
+		return err
+	}
+	// t 是否能插空 插空进入
+	// s.bytesAddr[offset:offset+8]
+	if len(values) == 1 {
+		value := values[0]
+		o, start, end, t := s.empty(offset)
+		need := 1 + uvarintSize(len(value)) + len(value)
+		if t && need <= end-start {
+			total := bigUint64(s.bytesAddr[offset : offset+8])
+			b := s.bytesAddr[o : o+total]
+			b[start] = 1
+			n := binary.PutUvarint(b[start+1:], uint64(len(value)))
+			copy(b[start+1+n:], value)
+			return nil
+		}
+	}
+	b8 := s.getB8byOffset(offset)
+	_, err := s.add(b8, key, values...)
+	return err
+}
+
+func (s *segment) del(offset int, valueMap map[string]struct{}) int {
+	total := bigUint64(s.bytesAddr[offset : offset+8])
+	if total == 0 {
+		return 0
+	}
+	b := s.bytesAddr[offset : offset+total]
+	for i := int(b[8] + 1 + 8); i < len(b[:len(b)-16]); {
+		if b[i] == 0 {
+			i++
+			continue
+		}
+		vlen, n := binary.Uvarint(b[i+1:])
+		slotLen := 1 + n + int(vlen)
+		value := string(b[i+1+n : i+slotLen])
+		if _, ok := valueMap[value]; ok {
+			copy(b[i:i+slotLen], make([]byte, slotLen))
+		}
+		i += slotLen
+	}
+	return bigUint64(b[total-8 : total])
+}
+
+func (s *segment) delPrefix(offset int, values ...string) int {
+	total := bigUint64(s.bytesAddr[offset : offset+8])
+	if total == 0 {
+		return 0
+	}
+	b := s.bytesAddr[offset : offset+total]
+	for i := int(b[8] + 1 + 8); i < len(b[:len(b)-16]); {
+		if b[i] == 0 {
+			i++
+			continue
+		}
+		vlen, n := binary.Uvarint(b[i+1:])
+		slotLen := 1 + n + int(vlen)
+		value := string(b[i+1+n : i+slotLen])
+		for _, v := range values {
+			if strings.HasPrefix(value, v) {
+				copy(b[i:i+slotLen], make([]byte, slotLen))
+				break
+			}
+		}
+		i += slotLen
+
+	}
+	return bigUint64(b[total-8 : total])
+}
+
+func (s *segment) get(offset int) ([]string, int) {
+	total := bigUint64(s.bytesAddr[offset : offset+8])
+	b := s.bytesAddr[offset : offset+total]
+	var list []string
+	for i := int(b[8] + 1 + 8); i < len(b[:len(b)-16]); {
+		if b[i] == 0 {
+			i++
+			continue
+		}
+		vlen, n := binary.Uvarint(b[i+1:])
+		list = append(list, string(b[i+1+n:i+1+n+int(vlen)]))
+		i += 1 + n + int(vlen)
+	}
+	lastDec := bigUint64(b[total-8 : total])
+	return list, lastDec
+}
+
+// uvarintSize 返回把 n 编码成 uvarint 需要的字节数，用来判断一个空位是否放得下（长度前缀+内容）。
+func uvarintSize(n int) int {
+	var buf [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(buf[:], uint64(n))
+}
+
+// bigUint64 对大数字进行解码 长度为0-8位的字节切片. binary.BigEndian.PutUint64 是编码.
+func bigUint64(buf []byte) int {
+	if len(buf) > 8 {
+		return 0
+	}
+	var x int
+	for _, b := range buf {
+		x = x<<8 | int(b)
+	}
+	return x
+}
@@ -0,0 +1,398 @@
+package msearch
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// notExist 标记不存在的key. // TODO 好像这个标记没什么用
+const notExist = -1
+
+const segmentFilePrefix = "segment-"
+const segmentFileSuffix = ".ms"
+
+// shard 是一整套独立的、按 key 哈希分片之后的存储：自己的锁、自己的一串 segment 文件、
+// 自己的墓碑日志，和其它 shard 完全不共享状态。Msearch（见 msearch.go）按 key 的哈希把
+// 请求路由到某一个 shard，分片之间读写互不阻塞。
+type shard struct {
+	mu             sync.RWMutex // mu to protect the follow fields
+	dir            string       // 存放所有 segment 文件和墓碑日志的目录
+	length         int          // 每个 segment mmap 的虚拟地址空间大小
+	maxSegmentSize int          // active segment 的数据区写到多大就封存
+	maxValueSize   int          // 单个 value 允许的最大长度，见 WithMaxValueSize
+	recoverStrict  bool         // 见 WithRecoverStrict
+	nextSegmentID  int
+
+	active *segment
+	sealed []*segment
+
+	tombstones    map[string]map[string]struct{} // key -> 被删掉、但还残留在 sealed segment 里的 value
+	tombstoneFile *os.File
+
+	keys *sortedKeySet // 这个分片见过的所有 key，按字典序维护，见 keys.go
+}
+
+// newShard 打开（或创建）dir 目录下的一个分片：dir 不存在会自动创建，length 是每个 segment
+// mmap 的虚拟地址空间大小，maxSegmentSize 是 active segment 写到多大就封存，maxValueSize 是
+// 单个 value 允许的最大长度，recoverStrict 控制每个 segment 在缺失索引头部、需要靠扫描值链
+// 恢复时，遇到被截断或损坏的记录该怎么办。
+func newShard(dir string, length int, maxSegmentSize int, maxValueSize int, recoverStrict bool) (*shard, error) {
+	if length <= 0 {
+		length = DefaultLength
+	}
+	if maxSegmentSize <= 0 {
+		maxSegmentSize = DefaultMaxSegmentSize
+	}
+	if maxValueSize <= 0 {
+		maxValueSize = DefaultMaxValueSize
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	ids, err := existingSegmentIDs(dir)
+	if err != nil {
+		return nil, err
+	}
+	s := &shard{
+		dir:            dir,
+		length:         length,
+		maxSegmentSize: maxSegmentSize,
+		maxValueSize:   maxValueSize,
+		recoverStrict:  recoverStrict,
+	}
+	// 哪个 segment 是 active 不能简单地猜"id 最大的那个"——Compact 合并出来的新 segment
+	// 的 id 会比 active 还大，所以单独用一个 marker 文件记录当前 active 的 id。
+	activeID, err := readActiveMarker(dir)
+	if err != nil {
+		return nil, err
+	}
+	if activeID == 0 {
+		activeID = 1
+		if err = writeActiveMarker(dir, activeID); err != nil {
+			return nil, err
+		}
+	}
+	for _, id := range ids {
+		if id == activeID {
+			continue
+		}
+		seg, err := openSegment(id, s.segmentPath(id), length, maxValueSize, recoverStrict)
+		if err != nil {
+			return nil, err
+		}
+		s.sealed = append(s.sealed, seg)
+	}
+	seg, err := openSegment(activeID, s.segmentPath(activeID), length, maxValueSize, recoverStrict)
+	if err != nil {
+		return nil, err
+	}
+	s.active = seg
+	s.nextSegmentID = activeID
+	for _, id := range ids {
+		if id > s.nextSegmentID {
+			s.nextSegmentID = id
+		}
+	}
+	tombstones, tf, err := openTombstoneLog(filepath.Join(dir, "tombstones.log"))
+	if err != nil {
+		return nil, err
+	}
+	s.tombstones = tombstones
+	s.tombstoneFile = tf
+
+	s.keys = newSortedKeySet()
+	for _, seg := range s.sealed {
+		for _, key := range seg.keysSnapshot() {
+			s.keys.add(key)
+		}
+	}
+	for _, key := range s.active.keysSnapshot() {
+		s.keys.add(key)
+	}
+	return s, nil
+}
+
+func (s *shard) segmentPath(id int) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%s%08d%s", segmentFilePrefix, id, segmentFileSuffix))
+}
+
+// existingSegmentIDs 列出目录下已有的 segment 文件，按 id 升序返回。
+func existingSegmentIDs(dir string) ([]int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, segmentFilePrefix) || !strings.HasSuffix(name, segmentFileSuffix) {
+			continue
+		}
+		idStr := strings.TrimSuffix(strings.TrimPrefix(name, segmentFilePrefix), segmentFileSuffix)
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+// Get one or more value.
+func (s *shard) Get(key string) []string {
+	// 先只加读锁试一次：如果涉及到的每个 segment 都已经缓存过这个 key（getMergedCached 的
+	// ok=true），就不用碰 keyMap 的写入，读读之间可以并发。只有遇到没缓存过的 key（第一次查
+	// 或者缓存被清过）才退回到会往 keyMap 回填的写锁路径，这一步没法避免加写锁。
+	s.mu.RLock()
+	if values, ok := s.getMergedCached(key); ok {
+		s.mu.RUnlock()
+		return values
+	}
+	s.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.getMerged(key)
+}
+
+// Add one or more value.
+func (s *shard) Add(key string, values ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.active.adds(key, values...); err != nil {
+		return err
+	}
+	s.keys.add(key)
+	// 重新写回来的 value 不该再被老墓碑当成已删除过滤掉。
+	for _, v := range values {
+		s.removeTombstone(key, v)
+	}
+	return s.rotateIfNeeded()
+}
+
+// Del one or more value.
+func (s *shard) Del(key string, values ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active.dels(key, values...)
+	s.tombstoneSealed(key, values)
+}
+
+// DelByPrefix 根据前缀删除.
+func (s *shard) DelByPrefix(key string, prefixes ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active.delsPrefix(key, prefixes...)
+	if len(prefixes) == 0 {
+		return
+	}
+	var matched []string
+	for _, seg := range s.sealed {
+		for _, v := range seg.gets(key) {
+			for _, p := range prefixes {
+				if strings.HasPrefix(v, p) {
+					matched = append(matched, v)
+					break
+				}
+			}
+		}
+	}
+	s.tombstoneSealed(key, matched)
+}
+
+// Update 更新。先删除所有老数据，然后更新新数据.
+func (s *shard) Update(key string, values ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	oldValues := s.getMerged(key)
+	s.active.dels(key, oldValues...)
+	s.tombstoneSealed(key, oldValues)
+	if err := s.active.adds(key, values...); err != nil {
+		return err
+	}
+	s.keys.add(key)
+	for _, v := range values {
+		s.removeTombstone(key, v)
+	}
+	return s.rotateIfNeeded()
+}
+
+func (s *shard) Exist(key string) bool {
+	s.mu.RLock()
+	if exist, ok := s.existCached(key); ok {
+		s.mu.RUnlock()
+		return exist
+	}
+	s.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.active.resolve(key); ok {
+		return true
+	}
+	for _, seg := range s.sealed {
+		if _, ok := seg.resolve(key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// existCached 跟 Exist 一样找 key 在不在，但只用各 segment 已经缓存好的 keyMap，不会触发
+// 回填，所以只持有 RLock 调用也是安全的。只要有一个 segment 还没缓存过这个 key 就返回
+// ok=false，调用方应该退回到会加写锁的路径。
+func (s *shard) existCached(key string) (exist bool, ok bool) {
+	if _, found, cached := s.active.resolveCached(key); !cached {
+		return false, false
+	} else if found {
+		return true, true
+	}
+	for _, seg := range s.sealed {
+		_, found, cached := seg.resolveCached(key)
+		if !cached {
+			return false, false
+		}
+		if found {
+			return true, true
+		}
+	}
+	return false, true
+}
+
+// getMerged 把 active 和所有 sealed segment 里这个 key 的 value 取并集，按先旧后新的顺序去重，
+// 再把记在墓碑里、应该被视为已删除的 value 过滤掉。
+func (s *shard) getMerged(key string) []string {
+	var merged []string
+	seen := make(map[string]struct{})
+	collect := func(values []string) {
+		for _, v := range values {
+			if _, ok := seen[v]; ok {
+				continue
+			}
+			seen[v] = struct{}{}
+			merged = append(merged, v)
+		}
+	}
+	for _, seg := range s.sealed {
+		collect(seg.gets(key))
+	}
+	collect(s.active.gets(key))
+	dead := s.tombstones[key]
+	if len(dead) == 0 {
+		return merged
+	}
+	alive := merged[:0]
+	for _, v := range merged {
+		if _, gone := dead[v]; gone {
+			continue
+		}
+		alive = append(alive, v)
+	}
+	return alive
+}
+
+// getMergedCached 跟 getMerged 一样合并出 key 当前的 value 列表，但只用各 segment 已经缓存好
+// 的 keyMap（见 segment.getsCached），不会触发任何 keyMap 回填写入，所以只持有 RLock 调用
+// 就是安全的。只要有一个 segment 还没缓存过这个 key，就返回 ok=false，调用方应该退回到
+// 会加写锁、让 resolve 把缓存补上的 getMerged。
+func (s *shard) getMergedCached(key string) (values []string, ok bool) {
+	var merged []string
+	seen := make(map[string]struct{})
+	collect := func(values []string) {
+		for _, v := range values {
+			if _, dup := seen[v]; dup {
+				continue
+			}
+			seen[v] = struct{}{}
+			merged = append(merged, v)
+		}
+	}
+	for _, seg := range s.sealed {
+		vs, cached := seg.getsCached(key)
+		if !cached {
+			return nil, false
+		}
+		collect(vs)
+	}
+	vs, cached := s.active.getsCached(key)
+	if !cached {
+		return nil, false
+	}
+	collect(vs)
+	dead := s.tombstones[key]
+	if len(dead) == 0 {
+		return merged, true
+	}
+	alive := merged[:0]
+	for _, v := range merged {
+		if _, gone := dead[v]; gone {
+			continue
+		}
+		alive = append(alive, v)
+	}
+	return alive, true
+}
+
+// tombstoneSealed 只要有某个 sealed segment 里有这个 key，就给传进来的每个 value 都记一条墓碑
+// （不逐个核对 value 是否真的在 sealed segment 里），这样下次 Get 合并结果的时候能把它们过滤掉——
+// sealed segment 本身是只读的，没法像 active 那样原地清零。
+func (s *shard) tombstoneSealed(key string, values []string) {
+	if len(values) == 0 || len(s.sealed) == 0 {
+		return
+	}
+	inSealed := false
+	for _, seg := range s.sealed {
+		if _, ok := seg.resolve(key); ok {
+			inSealed = true
+			break
+		}
+	}
+	if !inSealed {
+		// 没有任何 sealed segment 持有这个 key，active 那边原地清零就够了，不用记墓碑。
+		return
+	}
+	s.recordTombstones(key, values)
+}
+
+// rotateIfNeeded 如果 active segment 的数据区已经超过阈值，就把它封存成只读的 sealed segment，
+// 再开一个新的 active 接着写。
+func (s *shard) rotateIfNeeded() error {
+	if s.active.offset < s.maxSegmentSize {
+		return nil
+	}
+	s.sealed = append(s.sealed, s.active)
+	s.nextSegmentID++
+	seg, err := openSegment(s.nextSegmentID, s.segmentPath(s.nextSegmentID), s.length, s.maxValueSize, s.recoverStrict)
+	if err != nil {
+		return err
+	}
+	if err = writeActiveMarker(s.dir, s.nextSegmentID); err != nil {
+		return err
+	}
+	s.active = seg
+	return nil
+}
+
+// readActiveMarker 读取记录当前 active segment id 的 marker 文件；文件不存在（全新目录）返回 0。
+func readActiveMarker(dir string) (int, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "ACTIVE"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	id, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("msearch: malformed ACTIVE marker: %w", err)
+	}
+	return id, nil
+}
+
+func writeActiveMarker(dir string, id int) error {
+	return os.WriteFile(filepath.Join(dir, "ACTIVE"), []byte(strconv.Itoa(id)), 0644)
+}
@@ -0,0 +1,44 @@
+package msearch
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// benchmarkConcurrent 起 goroutines 个并发 goroutine，各自认领自己的一段 key 空间反复
+// Add/Get，用来衡量分片数对并发吞吐的影响。
+func benchmarkConcurrent(b *testing.B, shards, goroutines int) {
+	m, err := NewMsearch(b.TempDir(), 1<<20, WithShards(shards))
+	if err != nil {
+		b.Fatal(err)
+	}
+	perGoroutine := b.N / goroutines
+	if perGoroutine == 0 {
+		perGoroutine = 1
+	}
+	b.ResetTimer()
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < perGoroutine; i++ {
+				key := fmt.Sprintf("g%d-k%d", g, i%1024)
+				_ = m.Add(key, "v")
+				m.Get(key)
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+// 不分片（shards=1，等价于以前单个全局 RWMutex）作为基准。
+func BenchmarkConcurrency8Unsharded(b *testing.B)  { benchmarkConcurrent(b, 1, 8) }
+func BenchmarkConcurrency16Unsharded(b *testing.B) { benchmarkConcurrent(b, 1, 16) }
+func BenchmarkConcurrency32Unsharded(b *testing.B) { benchmarkConcurrent(b, 1, 32) }
+
+// 分 16 个 shard，对比同样的并发数下吞吐的提升。
+func BenchmarkConcurrency8Sharded16(b *testing.B)  { benchmarkConcurrent(b, 16, 8) }
+func BenchmarkConcurrency16Sharded16(b *testing.B) { benchmarkConcurrent(b, 16, 16) }
+func BenchmarkConcurrency32Sharded16(b *testing.B) { benchmarkConcurrent(b, 16, 32) }
@@ -0,0 +1,129 @@
+package msearch
+
+import (
+	"encoding/binary"
+	"os"
+)
+
+// tombstones.log 是一个只追加写的二进制日志，每条记录是 [uvarint keylen][key][uvarint valuelen][value]，
+// 用来记那些 value 曾经存在于某个 sealed segment、后来又被删掉了。sealed segment 本身不能改，
+// 所以墓碑就是它们记录删除状态的地方；Get 合并各个 segment 的结果时会把墓碑里的 value 过滤掉。
+// 长度前缀跟 segment.go 的 value 记录一样用 uvarint，而不是定长 2 字节——value 本身可以到
+// maxValueSize（默认 16MiB），2 字节的 uint16 装不下。
+
+// openTombstoneLog 读取已有的墓碑日志（如果有的话），并打开文件句柄供后续追加写入。
+func openTombstoneLog(path string) (map[string]map[string]struct{}, *os.File, error) {
+	tombstones, err := loadTombstoneLog(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	return tombstones, f, nil
+}
+
+func loadTombstoneLog(path string) (map[string]map[string]struct{}, error) {
+	out := make(map[string]map[string]struct{})
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return out, nil
+		}
+		return nil, err
+	}
+	i := 0
+	for i < len(data) {
+		klen, n := binary.Uvarint(data[i:])
+		if n <= 0 || i+n+int(klen) > len(data) {
+			break // 日志尾部被截断了，最后一条没写完整的直接丢弃
+		}
+		i += n
+		key := string(data[i : i+int(klen)])
+		i += int(klen)
+		vlen, n := binary.Uvarint(data[i:])
+		if n <= 0 || i+n+int(vlen) > len(data) {
+			break
+		}
+		i += n
+		value := string(data[i : i+int(vlen)])
+		i += int(vlen)
+		if out[key] == nil {
+			out[key] = make(map[string]struct{})
+		}
+		out[key][value] = struct{}{}
+	}
+	return out, nil
+}
+
+// recordTombstones 把 key 的这些 value 标记为已删除：先更新内存里的墓碑表供 Get 立刻生效，
+// 再追加写到日志文件里保证重启之后还记得。日志写失败这里不往上抛——Del 本身的签名就没有
+// 返回值，最多是老 segment 里那份数据多活一会儿，不影响新写入的数据。
+func (s *shard) recordTombstones(key string, values []string) {
+	if s.tombstones[key] == nil {
+		s.tombstones[key] = make(map[string]struct{}, len(values))
+	}
+	for _, v := range values {
+		if _, ok := s.tombstones[key][v]; ok {
+			continue
+		}
+		s.tombstones[key][v] = struct{}{}
+		appendTombstone(s.tombstoneFile, key, v)
+	}
+}
+
+// removeTombstone 撤销 key 上这个 value 的墓碑：value 被重新 Add 回来了，不该再被 Get
+// 当成已删除过滤掉。墓碑日志是只追加写的，没法单独删一行，这里直接按内存里现在的状态
+// 把整份日志重写一遍，保证重启之后读到的还是撤销之后的这份状态。
+func (s *shard) removeTombstone(key, value string) {
+	values := s.tombstones[key]
+	if values == nil {
+		return
+	}
+	if _, ok := values[value]; !ok {
+		return
+	}
+	delete(values, value)
+	if len(values) == 0 {
+		delete(s.tombstones, key)
+	}
+	s.rewriteTombstoneLog()
+}
+
+// rewriteTombstoneLog 把 s.tombstones 现在的内容整个重写到日志文件里，用来在撤销个别
+// 墓碑之后让持久化状态跟内存保持一致。写失败这里也不往上抛，跟 appendTombstone 一样。
+func (s *shard) rewriteTombstoneLog() {
+	path := s.tombstoneFile.Name()
+	var buf []byte
+	for key, values := range s.tombstones {
+		for value := range values {
+			buf = appendTombstoneTo(buf, key, value)
+		}
+	}
+	if err := os.WriteFile(path, buf, 0644); err != nil {
+		return
+	}
+	_ = s.tombstoneFile.Close()
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return
+	}
+	s.tombstoneFile = f
+}
+
+func appendTombstone(f *os.File, key, value string) {
+	_, _ = f.Write(appendTombstoneTo(nil, key, value))
+}
+
+// appendTombstoneTo 把一条 [uvarint keylen][key][uvarint valuelen][value] 记录编码后追加到 buf 末尾。
+func appendTombstoneTo(buf []byte, key, value string) []byte {
+	var lenBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lenBuf[:], uint64(len(key)))
+	buf = append(buf, lenBuf[:n]...)
+	buf = append(buf, key...)
+	n = binary.PutUvarint(lenBuf[:], uint64(len(value)))
+	buf = append(buf, lenBuf[:n]...)
+	buf = append(buf, value...)
+	return buf
+}